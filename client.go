@@ -1,14 +1,52 @@
 package pushpop
 
 import (
+	"context"
 	"database/sql"
+	"log"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/google/uuid"
 )
 
+const (
+	// listenMinReconnectInterval is the minimum backoff pq.NewListener will
+	// wait before attempting to reconnect a dropped LISTEN connection.
+	listenMinReconnectInterval = 20 * time.Millisecond
+
+	// listenMaxReconnectInterval is the maximum backoff pq.NewListener will
+	// wait before attempting to reconnect a dropped LISTEN connection.
+	listenMaxReconnectInterval = 1 * time.Minute
+
+	// workFallbackInterval bounds how long a worker pool will wait between
+	// drains when no notification arrives, guarding against notifications
+	// dropped during a listener reconnect.
+	workFallbackInterval = 30 * time.Second
+
+	// workVisibilityExtendInterval controls how often a handler that is
+	// still running has its message's visibility timeout extended.
+	workVisibilityExtendInterval = 1 * time.Minute
+
+	// workDefaultExtendBy is the duration a message's visibility is extended
+	// by on each extend tick while a handler is in-flight.
+	workDefaultExtendBy = 5 * time.Minute
+
+	// defaultVisibilityTimeout is how long a popped message is reserved for
+	// its consumer before it is eligible to be reclaimed.
+	defaultVisibilityTimeout = 5 * time.Minute
+
+	// defaultReaperInterval is how often StartReaper scans for expired
+	// pending messages when Client.ReaperInterval is unset.
+	defaultReaperInterval = 30 * time.Second
+
+	// cronPollInterval is how often PushCron checks whether its current
+	// occurrence has completed and needs to be re-scheduled.
+	cronPollInterval = 1 * time.Second
+)
+
 // ErrNoMessage is returned when a Message cannot be found. It will be returned
 // when you try to find a Message by id and it does not exist, or when you try
 // to Pop from an empty topic.
@@ -17,26 +55,57 @@ var ErrNoMessage = sql.ErrNoRows
 // Client represents a PushPop client with a connection pool to a backend
 // PostgreSQL database which will be used for message persistence.
 type Client struct {
-	db *sql.DB
+	// VisibilityTimeout is how long a popped message is reserved for its
+	// consumer before it becomes eligible to be reclaimed by the reaper.
+	// Defaults to 5 minutes; override per-call with PopWithOptions.
+	VisibilityTimeout time.Duration
+
+	// ReaperInterval controls how often StartReaper scans for expired
+	// pending messages. Defaults to 30 seconds.
+	ReaperInterval time.Duration
+
+	db  *sql.DB
+	url string
 }
 
 // HandlerFunc is a function that takes a Message and performs some work. In case
 // of an error, the message will be reqeueued.
 type HandlerFunc func(*Message) error
 
+// ClientConfig configures the construction of a Client.
+type ClientConfig struct {
+	// AutoMigrate runs any pending schema migrations as part of
+	// NewClientWithConfig. Operators who prefer to run migrations
+	// out-of-band (e.g. on a deployment hook, or against a read replica's
+	// primary) should set this to false and call Client.Migrate explicitly.
+	AutoMigrate bool
+}
+
 // NewClient creates a new Client for the given PostgreSQL database connection
-// url. It will automatically create or update tables or indices as necessary.
+// url, automatically applying any pending schema migrations. It is
+// equivalent to NewClientWithConfig(url, ClientConfig{AutoMigrate: true}).
 func NewClient(url string) (*Client, error) {
+	return NewClientWithConfig(url, ClientConfig{AutoMigrate: true})
+}
+
+// NewClientWithConfig creates a new Client for the given PostgreSQL database
+// connection url, as configured by cfg.
+func NewClientWithConfig(url string, cfg ClientConfig) (*Client, error) {
 	db, err := sql.Open("postgres", url)
 	if err != nil {
 		return nil, err
 	}
 	c := &Client{
-		db: db,
+		VisibilityTimeout: defaultVisibilityTimeout,
+		ReaperInterval:    defaultReaperInterval,
+		db:                db,
+		url:               url,
 	}
-	if err := c.setup(); err != nil {
-		c.db.Close()
-		return nil, err
+	if cfg.AutoMigrate {
+		if err := c.Migrate(context.Background()); err != nil {
+			c.db.Close()
+			return nil, err
+		}
 	}
 	return c, nil
 }
@@ -60,22 +129,81 @@ func (c *Client) NewMessage(topic string, payload ...[]byte) *Message {
 	return m
 }
 
+// PushOptions configures retry and dead-letter behavior for a Message pushed
+// via NewMessageWithOptions.
+type PushOptions struct {
+	// MaxAttempts is the maximum number of times the message may be popped
+	// before Message.Fail routes it to DeadLetterTopic (or discards it).
+	// Zero means unlimited attempts.
+	MaxAttempts int
+
+	// DeadLetterTopic, if set, is the topic a message is moved to once
+	// MaxAttempts is reached, rather than being discarded.
+	DeadLetterTopic string
+
+	// Backoff computes the delay before a deferred message becomes ready
+	// again, given the number of attempts made so far. If nil, a default
+	// exponential backoff is used. It is honored only when Fail is called on
+	// the Message value returned by NewMessageWithOptions; messages returned
+	// by Pop, PopBatch or FindMessage (including those handed to Work
+	// handlers) carry no Backoff and always use the default.
+	Backoff func(attempt int) time.Duration
+
+	// Priority controls delivery order within a topic; messages with a
+	// higher Priority are popped before those with a lower one.
+	Priority int
+}
+
+// NewMessageWithOptions creates (but does not enqueue) a new Message with the
+// given topic, retry options, and optional payload.
+func (c *Client) NewMessageWithOptions(topic string, opts PushOptions, payload ...[]byte) *Message {
+	m := c.NewMessage(topic, payload...)
+	m.MaxAttempts = opts.MaxAttempts
+	m.DeadLetterTopic = opts.DeadLetterTopic
+	m.backoff = opts.Backoff
+	m.Priority = opts.Priority
+	return m
+}
+
 // FindMessage finds a message by its primary identifier, a string
 // representation of a 16-byte UUID. The ErrNoMessage error will be
 // returned if the message does not exist.
 func (c *Client) FindMessage(id string) (*Message, error) {
 	msg := &Message{}
-	if err := c.db.QueryRow(sqlFindMessage, id).Scan(&msg.Id, &msg.Topic, &msg.State, &msg.StateTime, &msg.Payload); err != nil {
+	var reason sql.NullString
+	if err := c.db.QueryRow(sqlFindMessage, id).Scan(&msg.Id, &msg.Topic, &msg.State, &msg.StateTime, &msg.Payload, &msg.Attempts, &msg.MaxAttempts, &msg.DeadLetterTopic, &msg.Priority, &msg.OriginTopic, &reason); err != nil {
 		return nil, err
 	}
+	msg.Reason = reason.String
+	msg.c = c
 	return msg, nil
 }
 
+// PopOptions configures a single Pop call.
+type PopOptions struct {
+	// VisibilityTimeout overrides Client.VisibilityTimeout for this call,
+	// letting different consumers of the same topic choose their own
+	// reservation deadlines. Zero means use the client default.
+	VisibilityTimeout time.Duration
+}
+
 // Pop returns the next available message from the queue of the given topic,
 // if one exists. The message will be transitioned to the "pending" state, and
 // the receiver becomes responsible for transitioning the state of the message
-// using Complete, Discard, or Defer.
+// using Complete, Discard, or Defer. It reserves the message for
+// Client.VisibilityTimeout; use PopWithOptions to override this per call.
 func (c *Client) Pop(topic string) (*Message, error) {
+	return c.PopWithOptions(topic, PopOptions{})
+}
+
+// PopWithOptions behaves like Pop, but allows the visibility timeout to be
+// overridden for this call via opts.
+func (c *Client) PopWithOptions(topic string, opts PopOptions) (*Message, error) {
+	timeout := opts.VisibilityTimeout
+	if timeout == 0 {
+		timeout = c.VisibilityTimeout
+	}
+
 	tx, err := c.db.Begin()
 	if err != nil {
 		return nil, err
@@ -83,46 +211,355 @@ func (c *Client) Pop(topic string) (*Message, error) {
 	defer tx.Rollback()
 
 	msg := &Message{}
-	if err := tx.QueryRow(sqlPopMessage, topic).Scan(&msg.Id, &msg.Topic, &msg.State, &msg.StateTime, &msg.Payload); err != nil {
+	var reason sql.NullString
+	deadline := time.Now().Add(timeout).UTC()
+	if err := tx.QueryRow(sqlPopMessage, topic, deadline).Scan(&msg.Id, &msg.Topic, &msg.State, &msg.StateTime, &msg.Payload, &msg.Attempts, &msg.MaxAttempts, &msg.DeadLetterTopic, &msg.Priority, &msg.OriginTopic, &reason); err != nil {
 		return nil, err
 	}
 	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
+	msg.Reason = reason.String
 	msg.c = c
 	return msg, nil
 }
 
-// Work creates a given number of workers for the supplied topic, managing the
-// flow of messages and ensuring orderly shutdown of workers.
-func (c *Client) Work(topic string, n int, fn HandlerFunc) {
-	// TODO
-	panic("not implemented")
-}
+// PushBatch pushes multiple messages in a single round trip using a bulk
+// COPY, rather than one INSERT per message. Each message is made available
+// immediately unless its StateTime has already been set (e.g. to delay it).
+func (c *Client) PushBatch(msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
 
-// setup creates the required table and indices for pushpop to function.
-func (c *Client) setup() error {
-	ok := false
-	if err := c.db.QueryRow(`select exists (select 1 from information_schema.tables where table_name = 'pushpop_messages');`).Scan(&ok); err != nil {
+	tx, err := c.db.Begin()
+	if err != nil {
 		return err
 	}
-	if ok {
-		return nil
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("pushpop_messages", "id", "topic", "state", "state_time", "payload", "max_attempts", "dead_letter_topic", "priority"))
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if msg.Id == "" {
+			msg.Id = uuid.New().String()
+		}
+		if msg.c == nil {
+			msg.c = c
+		}
+		msg.State = State_READY
+		if msg.StateTime.IsZero() {
+			msg.StateTime = time.Now().UTC()
+		}
+		if _, err := stmt.Exec(msg.Id, msg.Topic, msg.State, msg.StateTime, msg.Payload, msg.MaxAttempts, msg.DeadLetterTopic, msg.Priority); err != nil {
+			return err
+		}
 	}
-	if _, err := c.db.Exec(sqlCreateMessages); err != nil {
+
+	if _, err := stmt.Exec(); err != nil {
 		return err
 	}
-	if _, err := c.db.Exec(sqlIndexMessagesReady); err != nil {
+	if err := stmt.Close(); err != nil {
 		return err
 	}
-	if _, err := c.db.Exec(sqlIndexMessagesPending); err != nil {
+	return tx.Commit()
+}
+
+// PopBatch returns up to n available messages from the queue of the given
+// topic in a single round trip, transitioning them all to the "pending"
+// state as with Pop. ErrNoMessage is returned if the topic is empty.
+func (c *Client) PopBatch(topic string, n int) ([]*Message, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deadline := time.Now().Add(c.VisibilityTimeout).UTC()
+	rows, err := tx.Query(sqlPopMessageBatch, topic, deadline, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []*Message
+	for rows.Next() {
+		msg := &Message{c: c}
+		var reason sql.NullString
+		if err := rows.Scan(&msg.Id, &msg.Topic, &msg.State, &msg.StateTime, &msg.Payload, &msg.Attempts, &msg.MaxAttempts, &msg.DeadLetterTopic, &msg.Priority, &msg.OriginTopic, &reason); err != nil {
+			return nil, err
+		}
+		msg.Reason = reason.String
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, ErrNoMessage
+	}
+	return msgs, nil
+}
+
+// StartReaper launches a background goroutine that periodically reclaims
+// messages stuck in State_PENDING past their visibility deadline, returning
+// them to State_READY so a crashed consumer doesn't strand them forever. The
+// goroutine exits when ctx is cancelled.
+func (c *Client) StartReaper(ctx context.Context) {
+	interval := c.ReaperInterval
+	if interval <= 0 {
+		interval = defaultReaperInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := c.db.Exec(sqlReapExpiredMessages); err != nil {
+					log.Println("pushpop: reap:", err)
+				}
+			}
+		}
+	}()
+}
+
+// ReplayDeadLetter moves up to n messages that Message.Fail routed to the
+// given dead-letter topic back onto the topic each one originally failed
+// from, resetting it to State_READY with a clean attempt count. It returns
+// the number of messages replayed.
+func (c *Client) ReplayDeadLetter(topic string, n int) (int, error) {
+	res, err := c.db.Exec(sqlReplayDeadLetter, topic, n)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(affected), nil
+}
+
+// Schedule pushes msg so that it becomes available to pop at the given time,
+// as a first-class alternative to Message.PushDelay for absolute times.
+func (c *Client) Schedule(msg *Message, at time.Time) error {
+	return c.pushAt(msg, at.UTC())
+}
+
+// CancelScheduled cancels a scheduled message by discarding it, but only if
+// it is still State_READY and has not yet become due. It returns
+// ErrNoMessage if the message could not be cancelled, either because it does
+// not exist, is already due, or has already been popped.
+func (c *Client) CancelScheduled(id string) error {
+	res, err := c.db.Exec(sqlCancelScheduled, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
 		return err
 	}
+	if affected == 0 {
+		return ErrNoMessage
+	}
 	return nil
 }
 
-// push pushes the given message to the queue.
+// PushCron schedules payload onto topic according to the 5-field cron spec
+// (minute hour day-of-month month day-of-week), re-scheduling the next
+// occurrence each time the pending message completes, so callers can express
+// recurring jobs without an external scheduler. The returned cancel func
+// stops further re-scheduling and cancels the current occurrence if it has
+// not yet become due; an occurrence that is already due is left in place.
+func (c *Client) PushCron(topic string, spec string, payload []byte) (cancel func(), err error) {
+	schedule, err := parseCronSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	mu := sync.Mutex{}
+	currentId := ""
+
+	scheduleNext := func() error {
+		msg := c.NewMessage(topic, payload)
+		at := schedule.next(time.Now())
+		if err := c.Schedule(msg, at); err != nil {
+			return err
+		}
+		mu.Lock()
+		currentId = msg.Id
+		mu.Unlock()
+		return nil
+	}
+
+	if err := scheduleNext(); err != nil {
+		return nil, err
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(cronPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				mu.Lock()
+				id := currentId
+				mu.Unlock()
+				if id == "" {
+					continue
+				}
+				msg, err := c.FindMessage(id)
+				if err != nil || msg.State != State_COMPLETED {
+					continue
+				}
+				if err := scheduleNext(); err != nil {
+					log.Println("pushpop: cron:", err)
+				}
+			}
+		}
+	}()
+
+	cancel = func() {
+		stop()
+		mu.Lock()
+		id := currentId
+		mu.Unlock()
+		if id != "" {
+			c.CancelScheduled(id)
+		}
+	}
+	return cancel, nil
+}
+
+// Work creates a given number of workers for the supplied topic, managing the
+// flow of messages and ensuring orderly shutdown of workers. It runs until
+// the process exits; use WorkContext for graceful shutdown.
+func (c *Client) Work(topic string, n int, fn HandlerFunc) {
+	if err := c.WorkContext(context.Background(), topic, n, fn); err != nil {
+		log.Println("pushpop: work:", err)
+	}
+}
+
+// WorkContext creates n workers for the supplied topic and dispatches
+// messages to them as they become available, using LISTEN/NOTIFY to react to
+// new messages instead of polling. It blocks until ctx is cancelled, at which
+// point dispatch stops, in-flight handlers are given a chance to finish, and
+// the listener is closed.
+func (c *Client) WorkContext(ctx context.Context, topic string, n int, fn HandlerFunc) error {
+	listener := pq.NewListener(c.url, listenMinReconnectInterval, listenMaxReconnectInterval, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("pushpop: listener:", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen("pushpop_" + topic); err != nil {
+		return err
+	}
+
+	jobs := make(chan *Message)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range jobs {
+				c.handle(msg, fn)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(workFallbackInterval)
+	defer ticker.Stop()
+
+	c.drain(ctx, topic, jobs)
+	for {
+		select {
+		case <-ctx.Done():
+			close(jobs)
+			wg.Wait()
+			return nil
+		case <-listener.Notify:
+			c.drain(ctx, topic, jobs)
+		case <-ticker.C:
+			c.drain(ctx, topic, jobs)
+		}
+	}
+}
+
+// drain repeatedly pops messages from topic and hands them to jobs until the
+// topic is empty, ctx is cancelled, or an unexpected error occurs.
+func (c *Client) drain(ctx context.Context, topic string, jobs chan<- *Message) {
+	for {
+		msg, err := c.Pop(topic)
+		if err == ErrNoMessage {
+			return
+		}
+		if err != nil {
+			log.Println("pushpop: pop:", err)
+			return
+		}
+		select {
+		case jobs <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handle invokes fn with msg, extending the message's visibility
+// periodically for as long as fn runs, then completes the message on success
+// or passes it to Message.Fail on error. The extend goroutine is fully joined before the
+// message is transitioned, so it never races with (or clobbers) the final
+// Complete/Fail call.
+func (c *Client) handle(msg *Message, fn HandlerFunc) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(workVisibilityExtendInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.Extend(workDefaultExtendBy)
+			}
+		}
+	}()
+
+	err := fn(msg)
+	close(done)
+	<-stopped
+
+	if err != nil {
+		msg.Fail(err.Error())
+		return
+	}
+	msg.Complete()
+}
+
+// push pushes the given message to the queue, becoming ready after delay.
 func (c *Client) push(msg *Message, delay time.Duration) error {
+	return c.pushAt(msg, time.Now().Add(delay).UTC())
+}
+
+// pushAt pushes the given message to the queue, becoming ready at the given
+// time.
+func (c *Client) pushAt(msg *Message, at time.Time) error {
 	if msg.Id == "" {
 		msg.Id = uuid.New().String()
 	}
@@ -130,7 +567,7 @@ func (c *Client) push(msg *Message, delay time.Duration) error {
 		msg.c = c
 	}
 	msg.State = State_READY
-	msg.StateTime = time.Now().Add(delay).UTC()
-	_, err := c.db.Exec(sqlPushMessage, msg.Id, msg.Topic, msg.State, msg.StateTime, msg.Payload)
+	msg.StateTime = at
+	_, err := c.db.Exec(sqlPushMessage, msg.Id, msg.Topic, msg.State, msg.StateTime, msg.Payload, msg.MaxAttempts, msg.DeadLetterTopic, msg.Priority)
 	return err
 }
@@ -2,9 +2,11 @@ package pushpop
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"os"
 	"sync"
+	"time"
 
 	"testing"
 
@@ -150,6 +152,504 @@ func TestPushpopClient(t *testing.T) {
 	expectPopNoMessage()
 }
 
+func TestReaperReclaimsExpiredMessages(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.ReaperInterval = 50 * time.Millisecond
+
+	msg := c.NewMessage("widgets", []byte("1"))
+	if err := msg.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a consumer popping the message and then crashing before
+	// checking in, by reserving it with an already-expired deadline.
+	if _, err := c.PopWithOptions("widgets", PopOptions{VisibilityTimeout: -1 * time.Second}); err != nil {
+		t.Fatalf("unexpected error popping: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.StartReaper(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := c.Pop("widgets")
+		if err == nil {
+			if got.Id != msg.Id {
+				t.Fatalf("expected %s, got %s", msg.Id, got.Id)
+			}
+			return
+		}
+		if err != ErrNoMessage {
+			t.Fatalf("unexpected error popping: %s", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reaper did not reclaim the expired message in time")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFailDefersThenRoutesToDeadLetter(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := c.NewMessageWithOptions("widgets", PushOptions{
+		MaxAttempts:     2,
+		DeadLetterTopic: "widgets.dead",
+		Backoff:         func(attempt int) time.Duration { return 0 },
+	}, []byte("poison"))
+	if err := msg.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	// First attempt: under MaxAttempts, so Fail defers it for retry.
+	popped, err := c.Pop("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if popped.Attempts != 1 {
+		t.Fatalf("expected Attempts 1, got %d", popped.Attempts)
+	}
+	if err := popped.Fail("boom"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second attempt: now at MaxAttempts, so Fail routes it to the DLQ.
+	popped, err = c.Pop("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if popped.Attempts != 2 {
+		t.Fatalf("expected Attempts 2, got %d", popped.Attempts)
+	}
+	if err := popped.Fail("still poison"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Pop("widgets"); err != ErrNoMessage {
+		t.Fatalf("expected widgets to be empty, got: %v", err)
+	}
+
+	dead, err := c.Pop("widgets.dead")
+	if err != nil {
+		t.Fatalf("expected message in dead-letter topic, got: %v", err)
+	}
+	if !bytes.Equal(dead.Payload, []byte("poison")) {
+		t.Fatalf("unexpected payload: %s", dead.Payload)
+	}
+	// Moving topic resets attempts to 0; this Pop from the dead-letter topic
+	// is then its first attempt there.
+	if dead.Attempts != 1 {
+		t.Fatalf("expected attempts reset after moving topic (1 after this pop), got %d", dead.Attempts)
+	}
+}
+
+func TestFailDiscardsWithReasonWhenNoDeadLetterTopic(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := c.NewMessageWithOptions("widgets", PushOptions{MaxAttempts: 1}, []byte("x"))
+	if err := msg.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	popped, err := c.Pop("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := popped.Fail("bad input"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := c.FindMessage(msg.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.State != State_DISCARDED {
+		t.Fatalf("expected State_DISCARDED, got %v", found.State)
+	}
+	if found.Reason != "bad input" {
+		t.Fatalf("expected reason %q, got %q", "bad input", found.Reason)
+	}
+}
+
+func TestDefaultBackoffNeverGoesNegative(t *testing.T) {
+	for _, attempt := range []int{0, 1, 12, 13, 34, 100} {
+		dur := defaultBackoff(attempt)
+		if dur <= 0 {
+			t.Fatalf("attempt %d: expected a positive backoff, got %s", attempt, dur)
+		}
+		if dur > time.Hour {
+			t.Fatalf("attempt %d: expected backoff capped at 1h, got %s", attempt, dur)
+		}
+	}
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := c.NewMessageWithOptions("widgets", PushOptions{
+		MaxAttempts:     1,
+		DeadLetterTopic: "widgets.dead",
+	}, []byte("poison"))
+	if err := msg.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	popped, err := c.Pop("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := popped.Fail("boom"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail routed it straight to the dead-letter topic, not the discard pile.
+	dead, err := c.FindMessage(msg.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead.Topic != "widgets.dead" || dead.State != State_READY {
+		t.Fatalf("expected message READY on widgets.dead, got topic=%s state=%v", dead.Topic, dead.State)
+	}
+	if dead.OriginTopic != "widgets" {
+		t.Fatalf("expected origin topic %q, got %q", "widgets", dead.OriginTopic)
+	}
+
+	n, err := c.ReplayDeadLetter("widgets.dead", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 message replayed, got %d", n)
+	}
+
+	replayed, err := c.Pop("widgets")
+	if err != nil {
+		t.Fatalf("expected message back on the source topic: %v", err)
+	}
+	if replayed.Id != msg.Id {
+		t.Fatalf("expected %s, got %s", msg.Id, replayed.Id)
+	}
+	if replayed.OriginTopic != "" {
+		t.Fatalf("expected origin topic cleared after replay, got %q", replayed.OriginTopic)
+	}
+}
+
+func TestPriorityOrdering(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	low := c.NewMessageWithOptions("widgets", PushOptions{Priority: 0}, []byte("low"))
+	if err := low.Push(); err != nil {
+		t.Fatal(err)
+	}
+	high := c.NewMessageWithOptions("widgets", PushOptions{Priority: 10}, []byte("high"))
+	if err := high.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := c.Pop("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Payload, []byte("high")) {
+		t.Fatalf("expected higher priority message first, got: %s", first.Payload)
+	}
+
+	second, err := c.Pop("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(second.Payload, []byte("low")) {
+		t.Fatalf("expected lower priority message second, got: %s", second.Payload)
+	}
+}
+
+func TestScheduleIsNotPoppableUntilDue(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := c.NewMessage("widgets", []byte("later"))
+	if err := c.Schedule(msg, time.Now().Add(200*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Pop("widgets"); err != ErrNoMessage {
+		t.Fatalf("expected no message before it's due, got: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	got, err := c.Pop("widgets")
+	if err != nil {
+		t.Fatalf("expected message to be poppable once due: %v", err)
+	}
+	if got.Id != msg.Id {
+		t.Fatalf("expected %s, got %s", msg.Id, got.Id)
+	}
+}
+
+func TestCancelScheduled(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := c.NewMessage("widgets", []byte("later"))
+	if err := c.Schedule(msg, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.CancelScheduled(msg.Id); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found, err := c.FindMessage(msg.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.State != State_DISCARDED {
+		t.Fatalf("expected State_DISCARDED, got %v", found.State)
+	}
+
+	// Already-cancelled (or already-due) messages can't be cancelled again.
+	if err := c.CancelScheduled(msg.Id); err != ErrNoMessage {
+		t.Fatalf("expected ErrNoMessage, got: %v", err)
+	}
+}
+
+func TestPushCronSchedulesAndFindsOccurrence(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cancel, err := c.PushCron("widgets", "* * * * *", []byte("tick"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	id := mustFindScheduledId(t, "widgets")
+
+	found, err := c.FindMessage(id)
+	if err != nil {
+		t.Fatalf("FindMessage on a PushCron occurrence: %s", err)
+	}
+	if found.State != State_READY {
+		t.Fatalf("expected State_READY, got %v", found.State)
+	}
+	if !bytes.Equal(found.Payload, []byte("tick")) {
+		t.Fatalf("unexpected payload: %s", found.Payload)
+	}
+}
+
+func TestWorkContextProcessesAndCompletesMessages(t *testing.T) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := c.NewMessage("widgets", []byte("1"))
+	if err := msg.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan *Message, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WorkContext(ctx, "widgets", 1, func(m *Message) error {
+			handled <- m
+			return nil
+		})
+	}()
+
+	select {
+	case got := <-handled:
+		if !bytes.Equal(got.Payload, msg.Payload) {
+			t.Fatalf("unexpected payload: %s", got.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was never invoked")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		found, err := c.FindMessage(msg.Id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if found.State == State_COMPLETED {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message was never completed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error from WorkContext: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WorkContext did not shut down after ctx was cancelled")
+	}
+}
+
+func BenchmarkPush(b *testing.B) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.NewMessage("widgets", []byte("x")).Push(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPushBatch(b *testing.B) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	const batchSize = 100
+	msgs := make([]*Message, batchSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		for j := range msgs {
+			msgs[j] = c.NewMessage("widgets", []byte("x"))
+		}
+		if err := c.PushBatch(msgs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPop(b *testing.B) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < b.N; i++ {
+		if err := c.NewMessage("widgets", []byte("x")).Push(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Pop("widgets"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPopBatch(b *testing.B) {
+	mustReset()
+
+	c, err := NewClient(postgresUrl)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	const batchSize = 100
+	for i := 0; i < b.N; i++ {
+		if err := c.NewMessage("widgets", []byte("x")).Push(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		if _, err := c.PopBatch("widgets", batchSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// mustFindScheduledId returns the id of the (single) scheduled message in
+// topic, for tests that need to inspect a message PushCron doesn't return an
+// id for.
+func mustFindScheduledId(t *testing.T, topic string) string {
+	t.Helper()
+
+	db, err := sql.Open("postgres", postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var id string
+	if err := db.QueryRow("SELECT id FROM pushpop_messages WHERE topic = $1", topic).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
 func mustReset() {
 	db, err := sql.Open("postgres", postgresUrl)
 	if err != nil {
@@ -160,4 +660,10 @@ func mustReset() {
 	if _, err := db.Exec("drop table if exists pushpop_messages"); err != nil {
 		panic(err)
 	}
+	// Also drop the migrations ledger, otherwise NewClient would see every
+	// migration recorded as already applied and never recreate the table
+	// it just dropped above.
+	if _, err := db.Exec("drop table if exists pushpop_schema_migrations"); err != nil {
+		panic(err)
+	}
 }
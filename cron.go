@@ -0,0 +1,130 @@
+package pushpop
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed 5-field cron expression (minute hour
+// day-of-month month day-of-week), used by PushCron to compute the next
+// occurrence after each run completes.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+
+	// domWildcard and dowWildcard record whether the day-of-month and
+	// day-of-week fields were "*", so next can apply standard cron's
+	// OR-when-both-restricted rule for the day fields.
+	domWildcard, dowWildcard bool
+}
+
+// cronField is the set of values a single cron field matches.
+type cronField map[int]bool
+
+// parseCronSpec parses a standard 5-field cron expression. Supported syntax
+// per field: "*", "*/step", "a", "a-b", "a-b/step", and comma-separated
+// combinations thereof.
+func parseCronSpec(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("pushpop: invalid cron spec %q: expected 5 fields", spec)
+	}
+
+	minute, err := parseCronField(fields[0], 0, 59)
+	if err != nil {
+		return nil, err
+	}
+	hour, err := parseCronField(fields[1], 0, 23)
+	if err != nil {
+		return nil, err
+	}
+	dom, err := parseCronField(fields[2], 1, 31)
+	if err != nil {
+		return nil, err
+	}
+	month, err := parseCronField(fields[3], 1, 12)
+	if err != nil {
+		return nil, err
+	}
+	dow, err := parseCronField(fields[4], 0, 6)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cronSchedule{
+		minute: minute, hour: hour, dom: dom, month: month, dow: dow,
+		domWildcard: fields[2] == "*", dowWildcard: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a single cron field, bounded to [min, max].
+func parseCronField(field string, min, max int) (cronField, error) {
+	values := cronField{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		rangePart := part
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			n, err := strconv.Atoi(part[idx+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("pushpop: invalid cron step %q", part)
+			}
+			step = n
+			rangePart = part[:idx]
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("pushpop: invalid cron value %q", part)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("pushpop: invalid cron value %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("pushpop: cron value %q out of range [%d,%d]", part, min, max)
+		}
+
+		for i := lo; i <= hi; i += step {
+			values[i] = true
+		}
+	}
+
+	return values, nil
+}
+
+// next returns the first minute-aligned time after from that matches the
+// schedule, searching at most 366 days ahead. If nothing matches within that
+// window, the first minute past its end is returned, which does not match.
+func (s *cronSchedule) next(from time.Time) time.Time {
+	t := from.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < 366*24*60; i++ {
+		// Standard cron semantics: when both day fields are restricted, a
+		// day matching either one is enough. If only one is restricted, the
+		// other (a wildcard matching every day) must not veto it.
+		var dayMatches bool
+		switch {
+		case !s.domWildcard && !s.dowWildcard:
+			dayMatches = s.dom[t.Day()] || s.dow[int(t.Weekday())]
+		case !s.domWildcard:
+			dayMatches = s.dom[t.Day()]
+		case !s.dowWildcard:
+			dayMatches = s.dow[int(t.Weekday())]
+		default:
+			dayMatches = true
+		}
+		if s.month[int(t.Month())] && dayMatches && s.hour[t.Hour()] && s.minute[t.Minute()] {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return t
+}
@@ -0,0 +1,67 @@
+package pushpop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNextOrsRestrictedDayFields(t *testing.T) {
+	// "0 0 13 * 5" is a classic standard-cron example: it should fire on the
+	// 13th of the month OR on any Friday, not only when both hold at once.
+	s, err := parseCronSpec("0 0 13 * 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2026, time.July, 27, 0, 0, 0, 0, time.UTC)
+	got := s.next(from)
+
+	if got.Hour() != 0 || got.Minute() != 0 {
+		t.Fatalf("expected midnight, got %s", got)
+	}
+	if got.Day() != 13 && got.Weekday() != time.Friday {
+		t.Fatalf("expected the 13th or a Friday, got %s (%s)", got, got.Weekday())
+	}
+
+	// Find the next Friday after `from`, independent of cronSchedule.next.
+	wantFriday := from.AddDate(0, 0, 1)
+	for wantFriday.Weekday() != time.Friday {
+		wantFriday = wantFriday.AddDate(0, 0, 1)
+	}
+	wantFriday = time.Date(wantFriday.Year(), wantFriday.Month(), wantFriday.Day(), 0, 0, 0, 0, time.UTC)
+
+	// Under (buggy) AND semantics, next would skip past this Friday looking
+	// for a day that is simultaneously the 13th and a Friday, which may not
+	// occur for months. OR semantics must return a match no later than it.
+	if got.After(wantFriday) {
+		t.Fatalf("expected a match by %s (the next Friday), got %s", wantFriday, got)
+	}
+}
+
+func TestCronScheduleNextHonorsSingleRestrictedDayField(t *testing.T) {
+	// With day-of-week wildcarded, only day-of-month should gate.
+	s, err := parseCronSpec("0 0 1 * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2026, time.July, 27, 0, 0, 0, 0, time.UTC)
+	got := s.next(from)
+	if got.Day() != 1 {
+		t.Fatalf("expected the 1st, got %s", got)
+	}
+}
+
+func TestCronScheduleNextEveryMinute(t *testing.T) {
+	s, err := parseCronSpec("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2026, time.July, 27, 12, 0, 30, 0, time.UTC)
+	got := s.next(from)
+	want := time.Date(2026, time.July, 27, 12, 1, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
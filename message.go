@@ -48,7 +48,37 @@ type Message struct {
 	// Payload is a byte slice payload containing the message contents.
 	Payload []byte
 
+	// Attempts is the number of times the message has been popped.
+	Attempts int
+
+	// MaxAttempts is the maximum number of times the message may be popped
+	// before it is routed to DeadLetterTopic (or discarded) by Fail. Zero
+	// means unlimited attempts.
+	MaxAttempts int
+
+	// DeadLetterTopic, if set, is the topic a message is moved to by Fail
+	// once MaxAttempts has been reached, rather than being discarded.
+	DeadLetterTopic string
+
+	// Reason holds the reason the message was discarded, if any.
+	Reason string
+
+	// Priority controls delivery order within a topic; messages with a
+	// higher Priority are popped before those with a lower one.
+	Priority int
+
+	// OriginTopic is the topic the message was moved from the last time it
+	// was routed to a dead-letter topic by Fail. It is empty unless the
+	// message currently sits on a dead-letter topic, and is what
+	// ReplayDeadLetter moves it back to.
+	OriginTopic string
+
 	c *Client
+
+	// backoff computes the delay before a deferred message becomes ready
+	// again. It is only populated in-process by NewMessageWithOptions and
+	// does not survive a round-trip through the database.
+	backoff func(attempt int) time.Duration
 }
 
 // Push pushes the message to the topic queue, making it available to be popped
@@ -75,11 +105,69 @@ func (m *Message) Discard() error {
 	return m.transitionAfter(State_DISCARDED, 0)
 }
 
+// DiscardWithReason marks the message as discarded, storing reason alongside
+// it for later inspection.
+func (m *Message) DiscardWithReason(reason string) error {
+	m.Reason = reason
+	m.State = State_DISCARDED
+	m.StateTime = time.Now().UTC()
+	_, err := m.c.db.Exec(sqlTransitionMessageWithReason, m.Id, m.State, m.StateTime, m.Reason)
+	return err
+}
+
 // Defer re-queues the message to be retried at a later time.
 func (m *Message) Defer(dur time.Duration) error {
 	return m.transitionAfter(State_READY, dur)
 }
 
+// Fail records a failed processing attempt. If MaxAttempts has not been
+// reached, the message is deferred using Backoff (or a default exponential
+// backoff). Otherwise it is moved to DeadLetterTopic if one is set, or
+// discarded with reason.
+func (m *Message) Fail(reason string) error {
+	if m.MaxAttempts > 0 && m.Attempts >= m.MaxAttempts {
+		if m.DeadLetterTopic != "" {
+			return m.moveTopic(m.DeadLetterTopic)
+		}
+		return m.DiscardWithReason(reason)
+	}
+
+	backoff := m.backoff
+	if backoff == nil {
+		backoff = defaultBackoff
+	}
+	return m.Defer(backoff(m.Attempts))
+}
+
+// moveTopic moves the message to a new topic, resetting it to State_READY
+// and zeroing its attempt count. OriginTopic records the topic it is being
+// moved from, so ReplayDeadLetter can move it back later.
+func (m *Message) moveTopic(topic string) error {
+	m.OriginTopic = m.Topic
+	m.Topic = topic
+	m.State = State_READY
+	m.Attempts = 0
+	m.StateTime = time.Now().UTC()
+	_, err := m.c.db.Exec(sqlMoveMessageTopic, m.Id, m.Topic, m.State, m.StateTime, m.OriginTopic)
+	return err
+}
+
+// defaultBackoff returns an exponential backoff duration for the given
+// attempt number, capped at one hour.
+func defaultBackoff(attempt int) time.Duration {
+	// 1<<12 seconds is already beyond the one-hour cap, and shifting much
+	// further overflows int64 into a negative duration, so clamp the shift
+	// amount rather than the result.
+	if attempt > 12 {
+		return time.Hour
+	}
+	dur := time.Second * time.Duration(1<<uint(attempt))
+	if dur > time.Hour {
+		return time.Hour
+	}
+	return dur
+}
+
 // Extend extends the deadline of the pending message.
 func (m *Message) Extend(dur time.Duration) error {
 	return m.transitionAfter(State_PENDING, dur)
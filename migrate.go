@@ -0,0 +1,74 @@
+package pushpop
+
+import (
+	"context"
+)
+
+// advisoryLockMigrate is an arbitrary constant used with
+// pg_advisory_xact_lock to serialize schema migrations across concurrent
+// Migrate callers (e.g. several processes calling NewClient at once).
+const advisoryLockMigrate = 837451902
+
+// Migration is a single, ordered schema change applied by Migrate.
+type Migration struct {
+	Version int
+	SQL     string
+}
+
+// migrations is the ordered set of schema changes pushpop knows how to
+// apply. Append to this list; never rewrite or reorder existing entries, or
+// already-migrated deployments will be left out of sync.
+var migrations = []Migration{
+	{Version: 1, SQL: sqlMigration1CreateMessages},
+	{Version: 2, SQL: sqlMigration2Notify},
+	{Version: 3, SQL: sqlMigration3Retries},
+	{Version: 4, SQL: sqlMigration4Priority},
+	{Version: 5, SQL: sqlMigration5OriginTopic},
+}
+
+// Migrate applies any migrations not yet recorded in
+// pushpop_schema_migrations, in order. Each migration runs in its own
+// transaction guarded by a Postgres advisory lock, so it is safe to call
+// Migrate concurrently (e.g. from several replicas starting up at once).
+func (c *Client) Migrate(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, sqlCreateSchemaMigrations); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := c.applyMigration(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration applies m if it has not already been recorded, taking the
+// advisory lock first so concurrent callers don't race on the same version.
+func (c *Client) applyMigration(ctx context.Context, m Migration) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, sqlAdvisoryXactLock, advisoryLockMigrate); err != nil {
+		return err
+	}
+
+	applied := false
+	if err := tx.QueryRowContext(ctx, sqlSchemaMigrationApplied, m.Version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, sqlRecordSchemaMigration, m.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,52 +1,149 @@
 package pushpop
 
 const (
-	sqlCreateMessages = `
+	// sqlCreateSchemaMigrations tracks which Migrations have been applied.
+	sqlCreateSchemaMigrations = `
+		CREATE TABLE IF NOT EXISTS pushpop_schema_migrations (
+			version int PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)
+	`
+
+	sqlAdvisoryXactLock = `SELECT pg_advisory_xact_lock($1)`
+
+	sqlSchemaMigrationApplied = `
+		SELECT EXISTS (SELECT 1 FROM pushpop_schema_migrations WHERE version = $1)
+	`
+
+	sqlRecordSchemaMigration = `
+		INSERT INTO pushpop_schema_migrations (version) VALUES ($1)
+	`
+
+	// sqlMigration1CreateMessages creates the original pushpop_messages
+	// table and its ready/pending indices.
+	sqlMigration1CreateMessages = `
 		CREATE TABLE pushpop_messages (
 			id uuid PRIMARY KEY,
 			topic text NOT NULL,
 			state smallint NOT NULL,
 			state_time timestamptz NOT NULL,
 			payload text
-		)
+		);
+		CREATE INDEX pushpop_messages_ready
+			ON pushpop_messages (topic, state, state_time)
+			WHERE state = 0;
+		CREATE INDEX pushpop_messages_pending
+			ON pushpop_messages (topic, state, state_time)
+			WHERE state = 1;
+	`
+
+	// sqlMigration2Notify notifies listeners on the "pushpop_<topic>"
+	// channel whenever a row is inserted or transitioned back to
+	// State_READY, so Work can react to new messages instead of polling.
+	sqlMigration2Notify = `
+		CREATE OR REPLACE FUNCTION pushpop_notify() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.state = 0 THEN
+				PERFORM pg_notify('pushpop_' || NEW.topic, NEW.id::text);
+			END IF;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE TRIGGER pushpop_messages_notify
+			AFTER INSERT OR UPDATE ON pushpop_messages
+			FOR EACH ROW EXECUTE PROCEDURE pushpop_notify();
 	`
-	sqlIndexMessagesReady = `
+
+	// sqlMigration3Retries adds retry counting and dead-letter support.
+	sqlMigration3Retries = `
+		ALTER TABLE pushpop_messages
+			ADD COLUMN attempts int NOT NULL DEFAULT 0,
+			ADD COLUMN max_attempts int NOT NULL DEFAULT 0,
+			ADD COLUMN dead_letter_topic text NOT NULL DEFAULT '',
+			ADD COLUMN reason text;
+	`
+
+	// sqlMigration4Priority adds priority ordering, replacing the ready
+	// index so it sorts by priority before state_time.
+	sqlMigration4Priority = `
+		ALTER TABLE pushpop_messages ADD COLUMN priority smallint NOT NULL DEFAULT 0;
+		DROP INDEX pushpop_messages_ready;
 		CREATE INDEX pushpop_messages_ready
-		ON pushpop_messages (topic, state, state_time)
-		WHERE state = 0
+			ON pushpop_messages (topic, state, priority DESC, state_time ASC)
+			WHERE state = 0;
 	`
-	sqlIndexMessagesPending = `
-		CREATE INDEX pushpop_messages_pending
-		ON pushpop_messages (topic, state, state_time)
-		WHERE state = 1
+
+	// sqlMigration5OriginTopic adds origin_topic, which moveTopic uses to
+	// remember the topic a message is routed from when Fail moves it to a
+	// dead-letter topic, so ReplayDeadLetter knows where to move it back to.
+	sqlMigration5OriginTopic = `
+		ALTER TABLE pushpop_messages ADD COLUMN origin_topic text NOT NULL DEFAULT '';
 	`
 
 	sqlPushMessage = `
 		INSERT INTO pushpop_messages
-			(id, topic, state, state_time, payload)
+			(id, topic, state, state_time, payload, max_attempts, dead_letter_topic, priority)
 		VALUES
-			($1, $2, $3, $4, $5)
+			($1, $2, $3, $4, $5, $6, $7, $8)
 	`
 
 	sqlPopMessage = `
 		UPDATE pushpop_messages
-		SET state = 1, state_time = (now() + interval '5 minutes')
+		SET state = 1, state_time = $2, attempts = attempts + 1
 		WHERE id = (
 			SELECT id
 			FROM pushpop_messages
 			WHERE topic = $1
 			AND state = 0
-			ORDER BY state_time ASC
-			FOR UPDATE
+			AND state_time <= now()
+			ORDER BY priority DESC, state_time ASC
+			FOR UPDATE SKIP LOCKED
 			LIMIT 1
 		)
-		RETURNING id, topic, state, state_time, payload;
+		RETURNING id, topic, state, state_time, payload, attempts, max_attempts, dead_letter_topic, priority, origin_topic, reason;
+	`
+
+	sqlPopMessageBatch = `
+		WITH cte AS (
+			SELECT id
+			FROM pushpop_messages
+			WHERE topic = $1
+			AND state = 0
+			AND state_time <= now()
+			ORDER BY priority DESC, state_time ASC
+			FOR UPDATE SKIP LOCKED
+			LIMIT $3
+		)
+		UPDATE pushpop_messages
+		SET state = 1, state_time = $2, attempts = attempts + 1
+		FROM cte
+		WHERE pushpop_messages.id = cte.id
+		RETURNING pushpop_messages.id, pushpop_messages.topic, pushpop_messages.state,
+			pushpop_messages.state_time, pushpop_messages.payload, pushpop_messages.attempts,
+			pushpop_messages.max_attempts, pushpop_messages.dead_letter_topic, pushpop_messages.priority,
+			pushpop_messages.origin_topic, pushpop_messages.reason;
+	`
+
+	sqlReapExpiredMessages = `
+		UPDATE pushpop_messages
+		SET state = 0, state_time = now()
+		WHERE state = 1
+		AND state_time < now()
 	`
 
 	sqlFindMessage = `
-		SELECT id, topic, state, state_time, payload
-		FROM messages
+		SELECT id, topic, state, state_time, payload, attempts, max_attempts, dead_letter_topic, priority, origin_topic, reason
+		FROM pushpop_messages
+		WHERE id = $1
+	`
+
+	sqlCancelScheduled = `
+		UPDATE pushpop_messages
+		SET state = 3, state_time = now()
 		WHERE id = $1
+		AND state = 0
+		AND state_time > now()
 	`
 
 	sqlTransitionMessage = `
@@ -55,4 +152,43 @@ const (
 				state_time = $3
 		WHERE id = $1
 	`
+
+	sqlTransitionMessageWithReason = `
+		UPDATE pushpop_messages
+		SET state = $2,
+				state_time = $3,
+				reason = $4
+		WHERE id = $1
+	`
+
+	sqlMoveMessageTopic = `
+		UPDATE pushpop_messages
+		SET topic = $2,
+				state = $3,
+				state_time = $4,
+				attempts = 0,
+				origin_topic = $5
+		WHERE id = $1
+	`
+
+	// sqlReplayDeadLetter moves up to n messages Fail routed to the
+	// dead-letter topic $1 back onto the topic they failed from, resetting
+	// them to State_READY with a clean attempt count.
+	sqlReplayDeadLetter = `
+		UPDATE pushpop_messages
+		SET topic = origin_topic,
+				state = 0,
+				state_time = now(),
+				attempts = 0,
+				origin_topic = ''
+		WHERE id IN (
+			SELECT id
+			FROM pushpop_messages
+			WHERE topic = $1
+			AND state = 0
+			AND origin_topic <> ''
+			ORDER BY state_time ASC
+			LIMIT $2
+		)
+	`
 )